@@ -0,0 +1,145 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seekableReadCloser adapts a *bytes.Reader to the io.ReadCloser the
+// IncrementalPageReader expects, while still satisfying io.Seeker so
+// ReadPages can exercise its seek-to-offset path.
+type seekableReadCloser struct {
+	*bytes.Reader
+}
+
+func (seekableReadCloser) Close() error { return nil }
+
+func TestGroupedBlockNumbersRoundTrip(t *testing.T) {
+	blockNos := make([]uint32, 0, 500)
+	for i := 0; i < 500; i++ {
+		// A mix of small and large deltas so more than one bit width is exercised
+		// across group boundaries (blockGroupSize == 128).
+		// Squares give deltas 2i-1, so the groups pack at widths 8, 9, 10 and 10.
+		blockNos = append(blockNos, uint32(i*i))
+	}
+
+	encoded := encodeGroupedBlockNumbers(blockNos)
+	decoded, err := readGroupedBlockNumbers(bytes.NewReader(encoded), uint32(len(blockNos)))
+	require.NoError(t, err)
+	assert.Equal(t, blockNos, decoded)
+}
+
+func TestGroupedBlockNumbersRoundTrip_PartialLastGroup(t *testing.T) {
+	// Not a multiple of blockGroupSize, so the last group is short.
+	blockNos := []uint32{0, 1, 2, 1000, 1001, 50000}
+
+	encoded := encodeGroupedBlockNumbers(blockNos)
+	decoded, err := readGroupedBlockNumbers(bytes.NewReader(encoded), uint32(len(blockNos)))
+	require.NoError(t, err)
+	assert.Equal(t, blockNos, decoded)
+}
+
+func TestIncrementIndexRoundTrip(t *testing.T) {
+	blockNos := []uint32{1, 5, 300, 70000, 1 << 24, (1 << 24) + 1}
+	pageOffsets := make([]int64, len(blockNos))
+	for i := range pageOffsets {
+		pageOffsets[i] = int64(i) * 100
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeIncrementIndex(&buf, blockNos, pageOffsets, 0))
+
+	reader := bytes.NewReader(buf.Bytes())
+	fanout, entries, err := readIncrementIndex(reader, reader)
+	require.NoError(t, err)
+	require.Len(t, entries, len(blockNos))
+
+	for i, blockNo := range blockNos {
+		entry, found := lookupIncrementIndexEntry(fanout, entries, blockNo)
+		require.True(t, found, "blockNo %d should be found", blockNo)
+		assert.Equal(t, pageOffsets[i], entry.FileOffset)
+	}
+
+	_, found := lookupIncrementIndexEntry(fanout, entries, 999999)
+	assert.False(t, found, "blockNo absent from the index should not be found")
+}
+
+func TestReadPagesRoundTrip(t *testing.T) {
+	originalPageSize := DatabasePageSize
+	SetDatabasePageSize(24)
+	defer SetDatabasePageSize(uint64(originalPageSize))
+
+	fileName := "base/1/16384"
+	pages := map[uint32][]byte{
+		3:  bytes.Repeat([]byte{0xAA}, int(DatabasePageSize)),
+		10: bytes.Repeat([]byte{0xBB}, int(DatabasePageSize)),
+		42: bytes.Repeat([]byte{0xCC}, int(DatabasePageSize)),
+	}
+	blockNos := []uint32{3, 10, 42}
+
+	var buf bytes.Buffer
+	err := writeMergedIncrement(&buf, fileName, 1, 1000, uint16(DatabasePageSize), blockNos,
+		func(blockNo uint32) ([]byte, error) { return pages[blockNo], nil })
+	require.NoError(t, err)
+
+	pageReader := &IncrementalPageReader{
+		PagedFile: seekableReadCloser{bytes.NewReader(buf.Bytes())},
+		FileName:  fileName,
+	}
+
+	got, err := pageReader.ReadPages([]uint32{3, 42, 999})
+	require.NoError(t, err)
+	assert.Equal(t, pages[3], got[3])
+	assert.Equal(t, pages[42], got[42])
+	_, found := got[999]
+	assert.False(t, found, "a block absent from the increment should not be returned")
+}
+
+func TestMergeIncrements_TieBreaksOnPerPageLSN(t *testing.T) {
+	originalPageSize := DatabasePageSize
+	SetDatabasePageSize(24)
+	defer SetDatabasePageSize(uint64(originalPageSize))
+
+	fileName := "base/1/16384"
+	makePage := func(pageLsn uint64, fill byte) []byte {
+		page := make([]byte, DatabasePageSize)
+		binary.LittleEndian.PutUint64(page[:sizeofInt64], pageLsn)
+		for i := sizeofInt64; i < len(page); i++ {
+			page[i] = fill
+		}
+		return page
+	}
+
+	// increment A has a high file-level lastLsn (500), but its copy of block 5
+	// is actually stale (pageLsn 99); it also owns block 9 outright.
+	pagesA := map[uint32][]byte{
+		5: makePage(99, 'A'),
+		9: makePage(500, 'A'),
+	}
+	var incrementA bytes.Buffer
+	require.NoError(t, writeMergedIncrement(&incrementA, fileName, 500, 1000, uint16(DatabasePageSize),
+		[]uint32{5, 9}, func(blockNo uint32) ([]byte, error) { return pagesA[blockNo], nil }))
+
+	// increment B has a lower file-level lastLsn (250) than A, but its copy of
+	// block 5 is the fresher one (pageLsn 200 > A's 99) and must win the merge.
+	pagesB := map[uint32][]byte{
+		5: makePage(200, 'B'),
+	}
+	var incrementB bytes.Buffer
+	require.NoError(t, writeMergedIncrement(&incrementB, fileName, 250, 1000, uint16(DatabasePageSize),
+		[]uint32{5}, func(blockNo uint32) ([]byte, error) { return pagesB[blockNo], nil }))
+
+	var merged bytes.Buffer
+	require.NoError(t, MergeIncrements(&merged, fileName, []io.Reader{&incrementA, &incrementB}))
+
+	parsed, err := parseIncrementForMerge(&merged, fileName)
+	require.NoError(t, err)
+	assert.Equal(t, pagesB[5], parsed.pages[5],
+		"block 5 should take increment B's fresher page despite A's higher file-level lastLsn")
+	assert.Equal(t, pagesA[9], parsed.pages[9])
+}